@@ -0,0 +1,409 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"fmt"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// changeOp identifies the kind of mutation a change stages.
+type changeOp int
+
+const (
+	changeSet changeOp = iota
+	changeDelete
+)
+
+// change is a single staged mutation within a ChangeSet.
+type change struct {
+	op  changeOp
+	key string
+
+	value   string
+	setOpts SetOptions
+
+	delOpts DeleteOptions
+}
+
+// ChangeResult describes what happened to a single staged change once
+// a ChangeSet was applied.
+type ChangeResult int
+
+const (
+	// ChangeApplied means the op succeeded and was left in place.
+	ChangeApplied ChangeResult = iota
+
+	// ChangeNotAttempted means the op did not take effect: it is the
+	// op whose failure aborted the batch (its Err is set), it was
+	// never reached because an earlier op in the batch failed, or the
+	// batch was a DryRun and this op's precondition did not hold.
+	ChangeNotAttempted
+
+	// ChangeRolledBack means the op had succeeded but was undone
+	// after a later op in the batch failed.
+	ChangeRolledBack
+
+	// ChangeRollbackFailed means the op had succeeded, a later op
+	// failed, and the attempt to undo this op also failed. The
+	// keyspace is left in a partially-applied state and the caller
+	// must reconcile it by hand.
+	ChangeRollbackFailed
+)
+
+func (r ChangeResult) String() string {
+	switch r {
+	case ChangeApplied:
+		return "applied"
+	case ChangeNotAttempted:
+		return "not attempted"
+	case ChangeRolledBack:
+		return "rolled back"
+	case ChangeRollbackFailed:
+		return "rollback failed"
+	default:
+		return "unknown"
+	}
+}
+
+// ChangeOutcome reports what became of one staged change.
+type ChangeOutcome struct {
+	Key    string
+	Result ChangeResult
+
+	// Err is the error returned for this op, if any. It is set for
+	// the op that caused the batch to abort, for any op whose
+	// rollback itself failed, and for any op a DryRun found would
+	// fail its precondition.
+	Err error
+
+	// TTLNotRestored is set on a ChangeRolledBack outcome when the
+	// key existed before Apply started. Node carries no TTL or
+	// expiration of its own, so a snapshot taken via Get cannot
+	// capture a key's prior TTL, and rollback can only restore the
+	// prior value: a key that had a TTL before the batch started
+	// comes back with no TTL (permanent) after rollback.
+	TTLNotRestored bool
+}
+
+// ChangeSetError is returned by Apply when a staged change fails. It
+// reports the fate of every op in the batch so the caller can decide
+// whether manual reconciliation is needed.
+type ChangeSetError struct {
+	// Cause is the error returned by the op that aborted the batch,
+	// or, for a DryRun, the first op found to violate its
+	// precondition.
+	Cause error
+
+	// Outcomes has one entry per staged change, in staging order.
+	Outcomes []ChangeOutcome
+}
+
+func (e *ChangeSetError) Error() string {
+	return fmt.Sprintf("client: changeset aborted: %v", e.Cause)
+}
+
+// ChangeSet stages a batch of Set/Delete operations against related
+// keys so they can be applied as a unit with Apply.
+//
+// etcd v2 has no native multi-key transaction, so Apply approximates
+// one: it snapshots every key the batch touches via Get, then
+// executes each op with a guard derived from that snapshot — PrevIndex
+// for a key that already existed, PrevExist: PrevNoExist for a key
+// Add is creating — so a concurrent writer aborts the batch instead
+// of racing with it. If any op fails, Apply rolls back the ops that
+// already succeeded, restoring each key's prior value or re-deleting a
+// key the batch had created. Unless IgnoreConflicts is set, each revert
+// is itself guarded (by the ModifiedIndex the forward op produced, or
+// PrevExist: PrevNoExist when recreating a removed key), so a second
+// writer can't race the rollback undetected either. Node exposes no
+// TTL, so a restored key's prior TTL cannot be recovered; see
+// ChangeOutcome.TTLNotRestored.
+//
+// A ChangeSet is not safe for concurrent use, and is good for exactly
+// one Apply; build a new one for the next batch.
+type ChangeSet struct {
+	keys KeysAPI
+
+	changes []*change
+
+	// DryRun, if true, makes Apply only validate preconditions: for
+	// every staged op it checks PrevValue/PrevIndex/PrevExist (or the
+	// guard Apply would have derived from the snapshot) against the
+	// snapshot, but performs no writes and never rolls back.
+	DryRun bool
+
+	// IgnoreConflicts, if true, makes Apply skip the guard it would
+	// otherwise derive from the snapshot (PrevIndex for an existing
+	// key, PrevExist: PrevNoExist for a new one), so staged ops apply
+	// regardless of concurrent modifications.
+	IgnoreConflicts bool
+}
+
+// Add stages a Set of key to value. opts is applied as given, except
+// that Apply derives a guard from the snapshot (unless IgnoreConflicts
+// is set): PrevIndex for a key that already exists, or
+// PrevExist: PrevNoExist for one that doesn't, so two batches racing
+// to create the same key can't silently clobber one another.
+func (cs *ChangeSet) Add(key, value string, opts *SetOptions) *ChangeSet {
+	c := &change{op: changeSet, key: key, value: value}
+	if opts != nil {
+		c.setOpts = *opts
+	}
+	cs.changes = append(cs.changes, c)
+	return cs
+}
+
+// Remove stages a Delete of key. opts is applied as given, except
+// that Apply fills in PrevIndex from the snapshot when opts leaves it
+// 0 (unless IgnoreConflicts is set) to guard against concurrent
+// modification. A key that is missing from the snapshot is not
+// deleted: Apply fails that op with ErrKeyNoExist.
+func (cs *ChangeSet) Remove(key string, opts *DeleteOptions) *ChangeSet {
+	c := &change{op: changeDelete, key: key}
+	if opts != nil {
+		c.delOpts = *opts
+	}
+	cs.changes = append(cs.changes, c)
+	return cs
+}
+
+// Apply executes every staged op. It returns the per-op outcomes
+// alongside a *ChangeSetError describing the batch if any op failed;
+// on full success it returns a nil error and every outcome is
+// ChangeApplied.
+func (cs *ChangeSet) Apply(ctx context.Context) ([]ChangeOutcome, error) {
+	snapshots := make([]*Node, len(cs.changes))
+	for i, c := range cs.changes {
+		resp, err := cs.keys.Get(ctx, c.key)
+		if err != nil {
+			if err == ErrKeyNoExist {
+				snapshots[i] = nil
+				continue
+			}
+			return nil, err
+		}
+		snapshots[i] = resp.Node
+	}
+
+	outcomes := make([]ChangeOutcome, len(cs.changes))
+	for i := range outcomes {
+		outcomes[i] = ChangeOutcome{Key: cs.changes[i].key, Result: ChangeNotAttempted}
+	}
+
+	if cs.DryRun {
+		return cs.dryRun(outcomes, snapshots)
+	}
+
+	applied := make([]*Response, len(cs.changes))
+	n := 0
+	for i, c := range cs.changes {
+		resp, err := cs.applyOne(ctx, c, snapshots[i])
+		if err != nil {
+			outcomes[i] = ChangeOutcome{Key: c.key, Result: ChangeNotAttempted, Err: err}
+			cs.rollback(ctx, outcomes, snapshots, applied, n)
+			return outcomes, &ChangeSetError{Cause: err, Outcomes: outcomes}
+		}
+		outcomes[i] = ChangeOutcome{Key: c.key, Result: ChangeApplied}
+		applied[i] = resp
+		n = i + 1
+	}
+
+	return outcomes, nil
+}
+
+// dryRun checks every staged op's precondition against snapshots
+// without writing anything. It validates every op, not just up to the
+// first failure, since no op has any side effect to unwind.
+func (cs *ChangeSet) dryRun(outcomes []ChangeOutcome, snapshots []*Node) ([]ChangeOutcome, error) {
+	var cause error
+
+	for i, c := range cs.changes {
+		var err error
+		switch c.op {
+		case changeSet:
+			err = checkSetPrecondition(cs.effectiveSetOpts(c, snapshots[i]), snapshots[i])
+		case changeDelete:
+			err = checkDeletePrecondition(cs.effectiveDeleteOpts(c, snapshots[i]), snapshots[i])
+		default:
+			err = fmt.Errorf("client: unknown changeset op %d", c.op)
+		}
+
+		if err != nil {
+			outcomes[i] = ChangeOutcome{Key: c.key, Result: ChangeNotAttempted, Err: err}
+			if cause == nil {
+				cause = err
+			}
+			continue
+		}
+		outcomes[i] = ChangeOutcome{Key: c.key, Result: ChangeApplied}
+	}
+
+	if cause != nil {
+		return outcomes, &ChangeSetError{Cause: cause, Outcomes: outcomes}
+	}
+	return outcomes, nil
+}
+
+// effectiveSetOpts returns the SetOptions applyOne and dryRun actually
+// guard a Set op with: c.setOpts, plus a guard derived from snap
+// unless IgnoreConflicts is set.
+func (cs *ChangeSet) effectiveSetOpts(c *change, snap *Node) SetOptions {
+	opts := c.setOpts
+	if cs.IgnoreConflicts {
+		return opts
+	}
+	if opts.PrevExist == PrevIgnore && snap == nil {
+		opts.PrevExist = PrevNoExist
+	}
+	if opts.PrevIndex == 0 && snap != nil {
+		opts.PrevIndex = snap.ModifiedIndex
+	}
+	return opts
+}
+
+// effectiveDeleteOpts returns the DeleteOptions applyOne and dryRun
+// actually guard a Delete op with: c.delOpts, plus a PrevIndex guard
+// derived from snap unless IgnoreConflicts is set.
+func (cs *ChangeSet) effectiveDeleteOpts(c *change, snap *Node) DeleteOptions {
+	opts := c.delOpts
+	if !cs.IgnoreConflicts && opts.PrevIndex == 0 && snap != nil {
+		opts.PrevIndex = snap.ModifiedIndex
+	}
+	return opts
+}
+
+// checkSetPrecondition evaluates opts against snap the way etcd's
+// server would for a Set: PrevExist/PrevValue/PrevIndex must agree
+// with the key's state in snap (nil meaning the key doesn't exist).
+func checkSetPrecondition(opts SetOptions, snap *Node) error {
+	exists := snap != nil
+
+	switch opts.PrevExist {
+	case PrevExist:
+		if !exists {
+			return ErrKeyNoExist
+		}
+	case PrevNoExist:
+		if exists {
+			return ErrKeyExists
+		}
+	}
+
+	if opts.PrevValue != "" && (!exists || snap.Value != opts.PrevValue) {
+		return ErrKeyExists
+	}
+	if opts.PrevIndex != 0 && (!exists || snap.ModifiedIndex != opts.PrevIndex) {
+		return ErrKeyExists
+	}
+
+	return nil
+}
+
+// checkDeletePrecondition evaluates opts against snap the way etcd's
+// server would for a Delete: the key must exist, and any PrevValue or
+// PrevIndex given must agree with snap.
+func checkDeletePrecondition(opts DeleteOptions, snap *Node) error {
+	if snap == nil {
+		return ErrKeyNoExist
+	}
+	if opts.PrevValue != "" && snap.Value != opts.PrevValue {
+		return ErrKeyExists
+	}
+	if opts.PrevIndex != 0 && snap.ModifiedIndex != opts.PrevIndex {
+		return ErrKeyExists
+	}
+	return nil
+}
+
+// applyOne executes a single staged change, guarded by
+// effectiveSetOpts/effectiveDeleteOpts unless IgnoreConflicts is set.
+// It returns the Response of the underlying Set/Delete so the caller
+// can use its resulting Node as the rollback guard.
+func (cs *ChangeSet) applyOne(ctx context.Context, c *change, snap *Node) (*Response, error) {
+	switch c.op {
+	case changeSet:
+		opts := cs.effectiveSetOpts(c, snap)
+		return cs.keys.Set(ctx, c.key, c.value, &opts)
+	case changeDelete:
+		if snap == nil {
+			return nil, ErrKeyNoExist
+		}
+		opts := cs.effectiveDeleteOpts(c, snap)
+		return cs.keys.Delete(ctx, c.key, &opts)
+	default:
+		return nil, fmt.Errorf("client: unknown changeset op %d", c.op)
+	}
+}
+
+// rollback undoes the first n staged changes, in reverse order. What
+// "undo" means depends on which op succeeded:
+//
+//   - a Set that created a key (no prior snap) is undone by deleting
+//     it, guarded by the ModifiedIndex the create produced;
+//   - a Set that updated an existing key (snap != nil) is undone by
+//     restoring snap's value, guarded by the ModifiedIndex the update
+//     produced;
+//   - a Delete (which applyOne only sends for a key present in the
+//     snapshot, so snap != nil) is undone by recreating snap's value guarded by
+//     PrevExist: PrevNoExist, since the key does not exist right now —
+//     a PrevIndex guard against a deleted key can never match and
+//     would make every rollback of a Remove fail.
+//
+// Unless IgnoreConflicts is set, in which case the reverts are
+// unguarded, the guard protects the revert write from racing a second
+// writer. It updates outcomes in place.
+func (cs *ChangeSet) rollback(ctx context.Context, outcomes []ChangeOutcome, snapshots []*Node, applied []*Response, n int) {
+	for i := n - 1; i >= 0; i-- {
+		c := cs.changes[i]
+		key := c.key
+		snap := snapshots[i]
+
+		var guard uint64
+		if !cs.IgnoreConflicts && applied[i] != nil && applied[i].Node != nil {
+			guard = applied[i].Node.ModifiedIndex
+		}
+
+		outcome := ChangeOutcome{Key: key}
+
+		var err error
+		switch {
+		case c.op == changeDelete:
+			opts := SetOptions{PrevExist: PrevNoExist}
+			if cs.IgnoreConflicts {
+				opts.PrevExist = PrevIgnore
+			}
+			_, err = cs.keys.Set(ctx, key, snap.Value, &opts)
+			outcome.TTLNotRestored = err == nil
+		case snap == nil:
+			_, err = cs.keys.Delete(ctx, key, &DeleteOptions{PrevIndex: guard})
+			if err == ErrKeyNoExist {
+				err = nil
+			}
+		default:
+			_, err = cs.keys.Set(ctx, key, snap.Value, &SetOptions{PrevIndex: guard})
+			outcome.TTLNotRestored = err == nil
+		}
+
+		if err != nil {
+			outcome.Result = ChangeRollbackFailed
+			outcome.Err = err
+		} else {
+			outcome.Result = ChangeRolledBack
+		}
+		outcomes[i] = outcome
+	}
+}
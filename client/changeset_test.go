@@ -0,0 +1,317 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"testing"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+)
+
+// fakeKeysAPI is a minimal in-memory KeysAPI used to drive ChangeSet
+// through mid-batch failures and concurrent ModifiedIndex changes
+// without a real etcd server. ChangeSet's only dependency is KeysAPI
+// (it never talks to httpClient directly), so that is the seam faked
+// here.
+type fakeKeysAPI struct {
+	nodes map[string]*Node
+	index uint64
+
+	calls []string
+
+	// failNext, keyed by key, is returned once by the next Set or
+	// Delete against that key, then cleared.
+	failNext map[string]error
+
+	// raceAfterGet, keyed by key, is installed into nodes right after
+	// Get reads that key (whether or not it was present), simulating a
+	// writer that creates or modifies the key in the window between
+	// ChangeSet's snapshot and its write.
+	raceAfterGet map[string]*Node
+}
+
+func newFakeKeysAPI() *fakeKeysAPI {
+	return &fakeKeysAPI{nodes: map[string]*Node{}}
+}
+
+func (f *fakeKeysAPI) seed(key, value string) *Node {
+	f.index++
+	n := &Node{Key: key, Value: value, ModifiedIndex: f.index, CreatedIndex: f.index}
+	f.nodes[key] = n
+	return n
+}
+
+func (f *fakeKeysAPI) Get(ctx context.Context, key string) (*Response, error) {
+	n, ok := f.nodes[key]
+	if pending, has := f.raceAfterGet[key]; has {
+		delete(f.raceAfterGet, key)
+		f.nodes[key] = pending
+	}
+	if !ok {
+		return nil, ErrKeyNoExist
+	}
+	cp := *n
+	return &Response{Node: &cp}, nil
+}
+
+func (f *fakeKeysAPI) RGet(ctx context.Context, key string) (*Response, error) {
+	return f.Get(ctx, key)
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *SetOptions) (*Response, error) {
+	f.calls = append(f.calls, "set:"+key)
+	if err := f.takeFailure(key); err != nil {
+		return nil, err
+	}
+
+	cur, exists := f.nodes[key]
+	if opts != nil {
+		switch opts.PrevExist {
+		case PrevExist:
+			if !exists {
+				return nil, ErrKeyNoExist
+			}
+		case PrevNoExist:
+			if exists {
+				return nil, ErrKeyExists
+			}
+		}
+		if opts.PrevIndex != 0 && (!exists || cur.ModifiedIndex != opts.PrevIndex) {
+			return nil, ErrKeyExists
+		}
+	}
+
+	f.index++
+	n := &Node{Key: key, Value: value, ModifiedIndex: f.index, CreatedIndex: f.index}
+	f.nodes[key] = n
+	cp := *n
+	return &Response{Node: &cp}, nil
+}
+
+func (f *fakeKeysAPI) Create(ctx context.Context, key, value string) (*Response, error) {
+	return f.Set(ctx, key, value, &SetOptions{PrevExist: PrevNoExist})
+}
+
+func (f *fakeKeysAPI) Update(ctx context.Context, key, value string) (*Response, error) {
+	return f.Set(ctx, key, value, &SetOptions{PrevExist: PrevExist})
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *DeleteOptions) (*Response, error) {
+	f.calls = append(f.calls, "delete:"+key)
+	if err := f.takeFailure(key); err != nil {
+		return nil, err
+	}
+
+	cur, exists := f.nodes[key]
+	if !exists {
+		return nil, ErrKeyNoExist
+	}
+	if opts != nil && opts.PrevIndex != 0 && cur.ModifiedIndex != opts.PrevIndex {
+		return nil, ErrKeyExists
+	}
+
+	delete(f.nodes, key)
+	cp := *cur
+	return &Response{Node: &cp}, nil
+}
+
+func (f *fakeKeysAPI) Watcher(key string, opts *WatcherOptions) Watcher { return nil }
+
+func (f *fakeKeysAPI) NewChangeSet() *ChangeSet { return &ChangeSet{keys: f} }
+
+func (f *fakeKeysAPI) takeFailure(key string) error {
+	if f.failNext == nil {
+		return nil
+	}
+	if err, ok := f.failNext[key]; ok {
+		delete(f.failNext, key)
+		return err
+	}
+	return nil
+}
+
+func TestChangeSetApplySuccess(t *testing.T) {
+	f := newFakeKeysAPI()
+	f.seed("/a", "1")
+
+	cs := f.NewChangeSet()
+	cs.Add("/a", "2", nil)
+	cs.Add("/b", "new", nil)
+
+	outcomes, err := cs.Apply(context.Background())
+	if err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+	for _, o := range outcomes {
+		if o.Result != ChangeApplied {
+			t.Errorf("key %s: got result %v, want ChangeApplied", o.Key, o.Result)
+		}
+	}
+	if f.nodes["/a"].Value != "2" {
+		t.Errorf("/a = %q, want %q", f.nodes["/a"].Value, "2")
+	}
+	if f.nodes["/b"].Value != "new" {
+		t.Errorf("/b = %q, want %q", f.nodes["/b"].Value, "new")
+	}
+}
+
+func TestChangeSetApplyMidBatchFailureRollsBack(t *testing.T) {
+	f := newFakeKeysAPI()
+	f.seed("/a", "orig")
+	f.failNext = map[string]error{"/b": ErrKeyExists}
+
+	cs := f.NewChangeSet()
+	cs.Add("/a", "changed", nil)
+	cs.Add("/b", "new", nil)
+
+	outcomes, err := cs.Apply(context.Background())
+	cserr, ok := err.(*ChangeSetError)
+	if !ok {
+		t.Fatalf("Apply error = %v (%T), want *ChangeSetError", err, err)
+	}
+	if cserr.Cause != ErrKeyExists {
+		t.Errorf("Cause = %v, want ErrKeyExists", cserr.Cause)
+	}
+
+	if outcomes[0].Result != ChangeRolledBack {
+		t.Errorf("outcomes[0].Result = %v, want ChangeRolledBack", outcomes[0].Result)
+	}
+	if !outcomes[0].TTLNotRestored {
+		t.Errorf("outcomes[0].TTLNotRestored = false, want true (Node carries no TTL to restore)")
+	}
+	if outcomes[1].Result != ChangeNotAttempted {
+		t.Errorf("outcomes[1].Result = %v, want ChangeNotAttempted", outcomes[1].Result)
+	}
+
+	if f.nodes["/a"].Value != "orig" {
+		t.Errorf("/a = %q after rollback, want %q", f.nodes["/a"].Value, "orig")
+	}
+	if _, exists := f.nodes["/b"]; exists {
+		t.Errorf("/b exists after a failed create, want it absent")
+	}
+}
+
+func TestChangeSetApplyRollsBackRemove(t *testing.T) {
+	f := newFakeKeysAPI()
+	f.seed("/a", "orig")
+	f.failNext = map[string]error{"/b": ErrKeyExists}
+
+	cs := f.NewChangeSet()
+	cs.Remove("/a", nil)
+	cs.Add("/b", "new", nil)
+
+	outcomes, err := cs.Apply(context.Background())
+	cserr, ok := err.(*ChangeSetError)
+	if !ok {
+		t.Fatalf("Apply error = %v (%T), want *ChangeSetError", err, err)
+	}
+	if cserr.Cause != ErrKeyExists {
+		t.Errorf("Cause = %v, want ErrKeyExists", cserr.Cause)
+	}
+
+	if outcomes[0].Result != ChangeRolledBack {
+		t.Fatalf("outcomes[0].Result = %v, want ChangeRolledBack", outcomes[0].Result)
+	}
+	if !outcomes[0].TTLNotRestored {
+		t.Errorf("outcomes[0].TTLNotRestored = false, want true (Node carries no TTL to restore)")
+	}
+
+	n, exists := f.nodes["/a"]
+	if !exists {
+		t.Fatalf("/a missing after rollback of its Remove, want it recreated")
+	}
+	if n.Value != "orig" {
+		t.Errorf("/a = %q after rollback, want %q", n.Value, "orig")
+	}
+}
+
+func TestChangeSetApplyGuardsConcurrentCreate(t *testing.T) {
+	f := newFakeKeysAPI()
+	// Simulate another writer creating /new in the window between
+	// ChangeSet's snapshot Get (which sees /new missing) and its Set.
+	f.raceAfterGet = map[string]*Node{"/new": {Key: "/new", Value: "racer", ModifiedIndex: 42}}
+
+	cs := f.NewChangeSet()
+	cs.Add("/new", "mine", nil)
+
+	outcomes, err := cs.Apply(context.Background())
+	cserr, ok := err.(*ChangeSetError)
+	if !ok {
+		t.Fatalf("Apply error = %v (%T), want *ChangeSetError", err, err)
+	}
+	if cserr.Cause != ErrKeyExists {
+		t.Errorf("Cause = %v, want ErrKeyExists (PrevNoExist guard should have fired)", cserr.Cause)
+	}
+	if outcomes[0].Result != ChangeNotAttempted {
+		t.Errorf("outcomes[0].Result = %v, want ChangeNotAttempted", outcomes[0].Result)
+	}
+	if f.nodes["/new"].Value != "racer" {
+		t.Errorf("/new = %q, want the racing writer's value %q to survive untouched", f.nodes["/new"].Value, "racer")
+	}
+}
+
+func TestChangeSetDryRunValidatesWithoutWriting(t *testing.T) {
+	f := newFakeKeysAPI()
+	f.seed("/a", "1")
+
+	cs := f.NewChangeSet()
+	cs.DryRun = true
+	cs.Add("/a", "2", nil)                                     // satisfiable: /a exists
+	cs.Add("/missing", "x", &SetOptions{PrevExist: PrevExist}) // not satisfiable: /missing doesn't exist
+
+	outcomes, err := cs.Apply(context.Background())
+	cserr, ok := err.(*ChangeSetError)
+	if !ok {
+		t.Fatalf("Apply error = %v (%T), want *ChangeSetError", err, err)
+	}
+	if cserr.Cause != ErrKeyNoExist {
+		t.Errorf("Cause = %v, want ErrKeyNoExist", cserr.Cause)
+	}
+	if outcomes[0].Result != ChangeApplied {
+		t.Errorf("outcomes[0].Result = %v, want ChangeApplied (precondition holds)", outcomes[0].Result)
+	}
+	if outcomes[1].Result != ChangeNotAttempted {
+		t.Errorf("outcomes[1].Result = %v, want ChangeNotAttempted", outcomes[1].Result)
+	}
+	if len(f.calls) != 0 {
+		t.Errorf("DryRun issued %d Set/Delete calls, want 0: %v", len(f.calls), f.calls)
+	}
+	if f.nodes["/a"].Value != "1" {
+		t.Errorf("/a = %q after DryRun, want untouched %q", f.nodes["/a"].Value, "1")
+	}
+}
+
+func TestChangeSetIgnoreConflicts(t *testing.T) {
+	f := newFakeKeysAPI()
+	n := f.seed("/a", "1")
+	// A concurrent writer bumps /a right after ChangeSet snapshots it,
+	// so the PrevIndex guard derived from the snapshot would not match.
+	f.raceAfterGet = map[string]*Node{"/a": {Key: "/a", Value: "concurrent", ModifiedIndex: n.ModifiedIndex + 100}}
+
+	cs := f.NewChangeSet()
+	cs.IgnoreConflicts = true
+	cs.Add("/a", "mine", nil)
+
+	outcomes, err := cs.Apply(context.Background())
+	if err != nil {
+		t.Fatalf("Apply returned error: %v", err)
+	}
+	if outcomes[0].Result != ChangeApplied {
+		t.Errorf("outcomes[0].Result = %v, want ChangeApplied", outcomes[0].Result)
+	}
+	if f.nodes["/a"].Value != "mine" {
+		t.Errorf("/a = %q, want %q (IgnoreConflicts should skip the guard)", f.nodes["/a"].Value, "mine")
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package dns implements a DNS / service-discovery record API layered
+// on top of client.KeysAPI. Names are stored the way CoreDNS's (and,
+// before it, SkyDNS's) etcd backend stores them: a DNS name is
+// reversed and joined into a path under a configurable prefix, so
+// "www.example.com" lives at "<prefix>/com/example/www", and the
+// value at that key is the JSON encoding of a Service.
+package dns
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/etcd/client"
+)
+
+// DefaultPrefix is the etcd key prefix used when none is given to
+// NewServiceAPI.
+const DefaultPrefix = "/skydns"
+
+var (
+	// ErrNotAService is returned when the node addressed by a name is
+	// a zone cut (it has children but no value of its own) rather
+	// than a leaf record.
+	ErrNotAService = errors.New("dns: not a service")
+
+	// ErrInvalidName is returned when a DNS name cannot be translated
+	// into an etcd key, e.g. because it contains an empty label, or a
+	// label that isn't plain ASCII. This package has no IDNA/punycode
+	// support, so an internationalized name must already be supplied
+	// in its ASCII-Compatible Encoding form (e.g. "xn--mller-kva.de")
+	// rather than as native Unicode ("müller.de"); see key.
+	ErrInvalidName = errors.New("dns: invalid name")
+)
+
+// Service is a single DNS / service-discovery record, modeled after
+// the record format used by SkyDNS/CoreDNS.
+type Service struct {
+	Host string `json:"host,omitempty"`
+	Port int    `json:"port,omitempty"`
+
+	Priority int `json:"priority,omitempty"`
+	Weight   int `json:"weight,omitempty"`
+
+	Text string `json:"text,omitempty"`
+	Mail bool   `json:"mail,omitempty"`
+
+	// TTL mirrors SetOptions.TTL: it is the etcd expiration applied
+	// when the record is written, so ephemeral records disappear on
+	// their own once a service stops refreshing them.
+	TTL uint32 `json:"ttl,omitempty"`
+
+	// TargetStrip is the number of labels to strip from Host before
+	// it is used as a CNAME/SRV target, mirroring SkyDNS's field of
+	// the same name.
+	TargetStrip int `json:"targetstrip,omitempty"`
+
+	// Group ties together Services that should be treated as
+	// members of the same round-robin/SRV group even though they
+	// live at different etcd keys.
+	Group string `json:"group,omitempty"`
+}
+
+// ServiceAPI publishes and resolves Service records stored under a
+// DNS-name-derived etcd keyspace.
+type ServiceAPI interface {
+	// Set publishes svc under name, overwriting any record already
+	// there. If svc.TTL is non-zero and opts does not already
+	// specify a TTL, the record is written with that expiration.
+	Set(ctx context.Context, name string, svc *Service, opts *client.SetOptions) (*Service, error)
+
+	// Get resolves the single Service published at name. It returns
+	// ErrNotAService if name addresses a zone cut rather than a leaf
+	// record.
+	Get(ctx context.Context, name string) (*Service, error)
+
+	// List resolves every Service published at or beneath name,
+	// walking the etcd tree recursively. It is the right call for a
+	// wildcard or round-robin/SRV lookup, where more than one record
+	// may answer the same name.
+	List(ctx context.Context, name string) ([]*Service, error)
+
+	// Delete removes the record published at name.
+	Delete(ctx context.Context, name string) error
+}
+
+type serviceAPI struct {
+	keys   client.KeysAPI
+	prefix string
+}
+
+// NewServiceAPI builds a ServiceAPI that stores records under
+// DefaultPrefix.
+func NewServiceAPI(k client.KeysAPI) ServiceAPI {
+	return NewServiceAPIWithPrefix(k, DefaultPrefix)
+}
+
+// NewServiceAPIWithPrefix acts like NewServiceAPI, but allows the
+// caller to root the keyspace at a custom prefix.
+func NewServiceAPIWithPrefix(k client.KeysAPI, prefix string) ServiceAPI {
+	return &serviceAPI{keys: k, prefix: strings.TrimRight(prefix, "/")}
+}
+
+func (s *serviceAPI) Set(ctx context.Context, name string, svc *Service, opts *client.SetOptions) (*Service, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+
+	val, err := json.Marshal(svc)
+	if err != nil {
+		return nil, err
+	}
+
+	var so client.SetOptions
+	if opts != nil {
+		so = *opts
+	}
+	if svc.TTL > 0 && so.TTL == 0 {
+		so.TTL = time.Duration(svc.TTL) * time.Second
+	}
+
+	resp, err := s.keys.Set(ctx, key, string(val), &so)
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeToService(resp.Node)
+}
+
+func (s *serviceAPI) Get(ctx context.Context, name string) (*Service, error) {
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.keys.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return nodeToService(resp.Node)
+}
+
+func (s *serviceAPI) List(ctx context.Context, name string) ([]*Service, error) {
+	name = strings.TrimPrefix(name, "*.")
+
+	key, err := s.key(name)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.keys.RGet(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var svcs []*Service
+	collectServices(resp.Node, &svcs)
+	return svcs, nil
+}
+
+func (s *serviceAPI) Delete(ctx context.Context, name string) error {
+	key, err := s.key(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.keys.Delete(ctx, key, nil)
+	return err
+}
+
+// key translates a DNS name such as "www.example.com" into the etcd
+// key it is stored under, e.g. "/skydns/com/example/www". A trailing
+// dot is ignored, and labels are lower-cased so that lookups are
+// case-insensitive the way DNS names are.
+//
+// This package does not implement IDNA/punycode normalization, so a
+// name with a non-ASCII label is rejected with ErrInvalidName rather
+// than silently mis-encoded; callers serving internationalized names
+// must convert them to their ASCII-Compatible Encoding (e.g.
+// "müller.de" -> "xn--mller-kva.de") before calling into ServiceAPI.
+func (s *serviceAPI) key(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if name == "" {
+		return s.prefix, nil
+	}
+
+	labels := strings.Split(name, ".")
+	for _, l := range labels {
+		if !isValidLabel(l) {
+			return "", ErrInvalidName
+		}
+	}
+
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return path.Join(s.prefix, path.Join(labels...)), nil
+}
+
+// isValidLabel reports whether s is usable as a single DNS label: at
+// least one character, drawn only from letters, digits, '-' and '_'
+// (the latter allowed because SRV records name their owner with a
+// leading underscore, e.g. "_sip._tcp.example.com", per RFC 2782).
+// This also rules out '/' and other path metacharacters, which would
+// otherwise let differently-dotted names collide on the same etcd key
+// once split on '.' and rejoined with path.Join, e.g. "a/b.com" and
+// "b.a.com" would both resolve to ".../com/a/b".
+func isValidLabel(s string) bool {
+	if s == "" {
+		return false
+	}
+	for _, r := range s {
+		switch {
+		case r >= 'a' && r <= 'z':
+		case r >= '0' && r <= '9':
+		case r == '-' || r == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NameFromKey reverses key, translating an etcd key produced by
+// ServiceAPI back into the DNS name it addresses. It is the inverse
+// of serviceAPI.key.
+func NameFromKey(prefix, key string) (string, error) {
+	prefix = strings.TrimRight(prefix, "/")
+	rel := strings.TrimPrefix(key, prefix)
+	rel = strings.Trim(rel, "/")
+	if rel == "" {
+		return "", nil
+	}
+
+	labels := strings.Split(rel, "/")
+	for i, j := 0, len(labels)-1; i < j; i, j = i+1, j-1 {
+		labels[i], labels[j] = labels[j], labels[i]
+	}
+
+	return strings.Join(labels, "."), nil
+}
+
+// nodeToService decodes the Service stored at n. It returns
+// ErrNotAService if n is a zone cut: a node with children but no
+// value of its own.
+func nodeToService(n *client.Node) (*Service, error) {
+	if n.Value == "" {
+		if len(n.Nodes) > 0 {
+			return nil, ErrNotAService
+		}
+		return nil, ErrNotAService
+	}
+
+	var svc Service
+	if err := json.Unmarshal([]byte(n.Value), &svc); err != nil {
+		return nil, err
+	}
+	return &svc, nil
+}
+
+// collectServices walks n and its children, appending every leaf
+// Service it finds to out. A leaf is a node with a value and no
+// children; nodes with children but no value are zone cuts and are
+// walked but not themselves collected.
+func collectServices(n *client.Node, out *[]*Service) {
+	if len(n.Nodes) == 0 {
+		if n.Value == "" {
+			return
+		}
+		if svc, err := nodeToService(n); err == nil {
+			*out = append(*out, svc)
+		}
+		return
+	}
+
+	for _, c := range n.Nodes {
+		collectServices(c, out)
+	}
+}
@@ -0,0 +1,356 @@
+// Copyright 2015 CoreOS, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dns
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/Godeps/_workspace/src/golang.org/x/net/context"
+	"github.com/coreos/etcd/client"
+)
+
+// fakeKeysAPI is a minimal in-memory client.KeysAPI, keyed flatly by
+// full path, with RGet returning every descendant of a key as a direct
+// child of one root Node, a flattened stand-in for the tree a real
+// etcd recursive Get returns.
+type fakeKeysAPI struct {
+	nodes map[string]*client.Node
+
+	// lastSetOpts is the SetOptions passed to the most recent Set.
+	lastSetOpts *client.SetOptions
+}
+
+var _ client.KeysAPI = (*fakeKeysAPI)(nil)
+
+func newFakeKeysAPI() *fakeKeysAPI {
+	return &fakeKeysAPI{nodes: map[string]*client.Node{}}
+}
+
+func (f *fakeKeysAPI) Set(ctx context.Context, key, value string, opts *client.SetOptions) (*client.Response, error) {
+	f.lastSetOpts = opts
+	n := &client.Node{Key: key, Value: value}
+	f.nodes[key] = n
+	cp := *n
+	return &client.Response{Node: &cp}, nil
+}
+
+func (f *fakeKeysAPI) Create(ctx context.Context, key, value string) (*client.Response, error) {
+	return f.Set(ctx, key, value, nil)
+}
+
+func (f *fakeKeysAPI) Update(ctx context.Context, key, value string) (*client.Response, error) {
+	return f.Set(ctx, key, value, nil)
+}
+
+func (f *fakeKeysAPI) Delete(ctx context.Context, key string, opts *client.DeleteOptions) (*client.Response, error) {
+	n, ok := f.nodes[key]
+	if !ok {
+		return nil, client.ErrKeyNoExist
+	}
+	delete(f.nodes, key)
+	return &client.Response{Node: n}, nil
+}
+
+// Get mimics etcd's non-recursive Get: an exact leaf match returns
+// that node, but a key with no value of its own and at least one
+// child still resolves, as a directory node listing only its
+// immediate children (not a full recursive subtree, which is what
+// distinguishes it from RGet).
+func (f *fakeKeysAPI) Get(ctx context.Context, key string) (*client.Response, error) {
+	if n, ok := f.nodes[key]; ok {
+		cp := *n
+		return &client.Response{Node: &cp}, nil
+	}
+
+	dir := &client.Node{Key: key}
+	found := false
+	prefix := key + "/"
+	for k, n := range f.nodes {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+		rest := strings.TrimPrefix(k, prefix)
+		if strings.Contains(rest, "/") {
+			continue // not an immediate child
+		}
+		found = true
+		dir.Nodes = append(dir.Nodes, &client.Node{Key: k, Value: n.Value})
+	}
+
+	if !found {
+		return nil, client.ErrKeyNoExist
+	}
+	return &client.Response{Node: dir}, nil
+}
+
+// RGet returns key's own value, if any, and every descendant of key
+// from the flat nodes map as a direct child of the returned Node; the
+// nesting of a real etcd recursive Get is not rebuilt.
+func (f *fakeKeysAPI) RGet(ctx context.Context, key string) (*client.Response, error) {
+	root := &client.Node{Key: key}
+	found := false
+
+	if n, ok := f.nodes[key]; ok {
+		root.Value = n.Value
+		found = true
+	}
+	for k, n := range f.nodes {
+		if k == key || !strings.HasPrefix(k, key+"/") {
+			continue
+		}
+		found = true
+		root.Nodes = append(root.Nodes, &client.Node{Key: k, Value: n.Value})
+	}
+
+	if !found {
+		return nil, client.ErrKeyNoExist
+	}
+	return &client.Response{Node: root}, nil
+}
+
+func (f *fakeKeysAPI) Watcher(key string, opts *client.WatcherOptions) client.Watcher { return nil }
+
+func (f *fakeKeysAPI) NewChangeSet() *client.ChangeSet { return nil }
+
+func TestKeyReversedPathEncoding(t *testing.T) {
+	s := &serviceAPI{prefix: DefaultPrefix}
+
+	cases := []struct {
+		name string
+		want string
+	}{
+		{"www.example.com", "/skydns/com/example/www"},
+		{"www.example.com.", "/skydns/com/example/www"}, // trailing dot is ignored
+		{"WWW.Example.COM", "/skydns/com/example/www"},  // case-insensitive
+		{"example.com", "/skydns/com/example"},
+		{"", "/skydns"},
+	}
+
+	for _, c := range cases {
+		got, err := s.key(c.name)
+		if err != nil {
+			t.Errorf("key(%q) returned error: %v", c.name, err)
+			continue
+		}
+		if got != c.want {
+			t.Errorf("key(%q) = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestKeyRejectsEmptyLabel(t *testing.T) {
+	s := &serviceAPI{prefix: DefaultPrefix}
+
+	if _, err := s.key("www..example.com"); err != ErrInvalidName {
+		t.Errorf("key with empty label returned %v, want ErrInvalidName", err)
+	}
+}
+
+func TestKeyRejectsSlashInLabel(t *testing.T) {
+	s := &serviceAPI{prefix: DefaultPrefix}
+
+	if _, err := s.key("a/b.com"); err != ErrInvalidName {
+		t.Errorf(`key("a/b.com") = %v, want ErrInvalidName`, err)
+	}
+
+	// Without the rejection above, "a/b.com" and "b.a.com" would
+	// collide on the same etcd key once split on '.' and rejoined
+	// with path.Join.
+	collider, err := s.key("b.a.com")
+	if err != nil {
+		t.Fatalf(`key("b.a.com") returned error: %v`, err)
+	}
+	if want := "/skydns/com/a/b"; collider != want {
+		t.Fatalf(`key("b.a.com") = %q, want %q`, collider, want)
+	}
+}
+
+func TestKeyAllowsSRVUnderscoreLabels(t *testing.T) {
+	s := &serviceAPI{prefix: DefaultPrefix}
+
+	got, err := s.key("_sip._tcp.example.com")
+	if err != nil {
+		t.Fatalf(`key("_sip._tcp.example.com") returned error: %v`, err)
+	}
+	if want := "/skydns/com/example/_tcp/_sip"; got != want {
+		t.Errorf(`key("_sip._tcp.example.com") = %q, want %q`, got, want)
+	}
+}
+
+func TestKeyRejectsNonASCIILabel(t *testing.T) {
+	s := &serviceAPI{prefix: DefaultPrefix}
+
+	// IDN edge case: this package has no punycode support, so a
+	// native-Unicode label must be refused rather than silently
+	// mis-encoded.
+	if _, err := s.key("müller.de"); err != ErrInvalidName {
+		t.Errorf("key(%q) = %v, want ErrInvalidName", "müller.de", err)
+	}
+
+	// Its ASCII-Compatible Encoding form is accepted like any other
+	// ASCII name.
+	got, err := s.key("xn--mller-kva.de")
+	if err != nil {
+		t.Fatalf("key(%q) returned error: %v", "xn--mller-kva.de", err)
+	}
+	if want := "/skydns/de/xn--mller-kva"; got != want {
+		t.Errorf("key(%q) = %q, want %q", "xn--mller-kva.de", got, want)
+	}
+}
+
+func TestNameFromKeyRoundTrip(t *testing.T) {
+	s := &serviceAPI{prefix: DefaultPrefix}
+
+	names := []string{"www.example.com", "example.com", "a.b.c.example.com"}
+	for _, name := range names {
+		key, err := s.key(name)
+		if err != nil {
+			t.Fatalf("key(%q) returned error: %v", name, err)
+		}
+		got, err := NameFromKey(DefaultPrefix, key)
+		if err != nil {
+			t.Fatalf("NameFromKey(%q, %q) returned error: %v", DefaultPrefix, key, err)
+		}
+		if got != name {
+			t.Errorf("NameFromKey(%q, %q) = %q, want %q", DefaultPrefix, key, got, name)
+		}
+	}
+}
+
+func TestServiceSetGetRoundTrip(t *testing.T) {
+	cases := map[string]*Service{
+		"a-record":    {Host: "192.0.2.1"},
+		"aaaa-record": {Host: "2001:db8::1"},
+		"srv-record":  {Host: "srv.example.com", Port: 8080, Priority: 10, Weight: 60, TargetStrip: 1},
+		"txt-record":  {Text: "v=spf1 -all"},
+		"cname-like":  {Host: "canonical.example.com", TTL: 300},
+	}
+
+	for name, svc := range cases {
+		t.Run(name, func(t *testing.T) {
+			f := newFakeKeysAPI()
+			api := NewServiceAPI(f)
+
+			fqdn := name + ".example.com"
+			if _, err := api.Set(context.Background(), fqdn, svc, nil); err != nil {
+				t.Fatalf("Set returned error: %v", err)
+			}
+
+			got, err := api.Get(context.Background(), fqdn)
+			if err != nil {
+				t.Fatalf("Get returned error: %v", err)
+			}
+
+			if *got != *svc {
+				t.Errorf("Get(%q) = %+v, want %+v", fqdn, *got, *svc)
+			}
+		})
+	}
+}
+
+func TestServiceSetAppliesTTL(t *testing.T) {
+	f := newFakeKeysAPI()
+	api := NewServiceAPI(f)
+
+	svc := &Service{Host: "192.0.2.1", TTL: 30}
+	if _, err := api.Set(context.Background(), "ephemeral.example.com", svc, nil); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	// The fake doesn't model expiration, but it records the SetOptions
+	// Set was called with, so the translation of Service.TTL into
+	// SetOptions.TTL can be checked directly.
+	if f.lastSetOpts == nil || f.lastSetOpts.TTL != 30*time.Second {
+		t.Errorf("Set passed SetOptions %+v, want TTL %v", f.lastSetOpts, 30*time.Second)
+	}
+
+	got, err := api.Get(context.Background(), "ephemeral.example.com")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if got.TTL != 30 {
+		t.Errorf("Get(...).TTL = %d, want 30", got.TTL)
+	}
+}
+
+func TestServiceListRoundRobinGroup(t *testing.T) {
+	f := newFakeKeysAPI()
+	api := NewServiceAPI(f)
+	ctx := context.Background()
+
+	members := []*Service{
+		{Host: "10.0.0.1", Port: 80, Group: "web"},
+		{Host: "10.0.0.2", Port: 80, Group: "web"},
+		{Host: "10.0.0.3", Port: 80, Group: "web"},
+	}
+	for i, svc := range members {
+		name := strings.Repeat("x", i+1) + ".web.example.com"
+		if _, err := api.Set(ctx, name, svc, nil); err != nil {
+			t.Fatalf("Set(%q) returned error: %v", name, err)
+		}
+	}
+
+	got, err := api.List(ctx, "*.web.example.com")
+	if err != nil {
+		t.Fatalf("List returned error: %v", err)
+	}
+	if len(got) != len(members) {
+		t.Fatalf("List returned %d services, want %d", len(got), len(members))
+	}
+
+	seen := map[string]bool{}
+	for _, svc := range got {
+		seen[svc.Host] = true
+	}
+	for _, want := range members {
+		if !seen[want.Host] {
+			t.Errorf("List result missing host %q", want.Host)
+		}
+	}
+}
+
+func TestServiceGetOnZoneCutFails(t *testing.T) {
+	f := newFakeKeysAPI()
+	api := NewServiceAPI(f)
+	ctx := context.Background()
+
+	if _, err := api.Set(ctx, "www.example.com", &Service{Host: "10.0.0.1"}, nil); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+
+	// "example.com" has a child ("www") but no value of its own: a
+	// zone cut, not a leaf service.
+	if _, err := api.Get(ctx, "example.com"); err != ErrNotAService {
+		t.Errorf("Get on zone cut returned %v, want ErrNotAService", err)
+	}
+}
+
+func TestServiceDelete(t *testing.T) {
+	f := newFakeKeysAPI()
+	api := NewServiceAPI(f)
+	ctx := context.Background()
+
+	if _, err := api.Set(ctx, "www.example.com", &Service{Host: "10.0.0.1"}, nil); err != nil {
+		t.Fatalf("Set returned error: %v", err)
+	}
+	if err := api.Delete(ctx, "www.example.com"); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if _, err := api.Get(ctx, "www.example.com"); err != client.ErrKeyNoExist {
+		t.Errorf("Get after Delete returned %v, want client.ErrKeyNoExist", err)
+	}
+}
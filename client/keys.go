@@ -66,6 +66,11 @@ type KeysAPI interface {
 	RGet(ctx context.Context, key string) (*Response, error)
 
 	Watcher(key string, opts *WatcherOptions) Watcher
+
+	// NewChangeSet returns an empty ChangeSet that stages Set/Delete
+	// operations against this KeysAPI for application as a unit via
+	// ChangeSet.Apply.
+	NewChangeSet() *ChangeSet
 }
 
 type WatcherOptions struct {
@@ -254,6 +259,10 @@ func (k *httpKeysAPI) RGet(ctx context.Context, key string) (*Response, error) {
 	return unmarshalHTTPResponse(resp.StatusCode, resp.Header, body)
 }
 
+func (k *httpKeysAPI) NewChangeSet() *ChangeSet {
+	return &ChangeSet{keys: k}
+}
+
 func (k *httpKeysAPI) Watcher(key string, opts *WatcherOptions) Watcher {
 	act := waitAction{
 		Prefix: k.prefix,